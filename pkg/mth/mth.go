@@ -0,0 +1,271 @@
+// Package mth implements an incremental Merkle tree hash over a stream of
+// bytes, in the style of tree-hash constructions such as BLAKE3's Merkle
+// tree mode. Callers feed bytes through Write as they are produced; the
+// hasher buffers at most one partial leaf plus O(log N) completed subtree
+// hashes, regardless of how much data has been written.
+package mth
+
+import "crypto/sha256"
+
+// LeafSize is the number of plaintext bytes hashed into a single leaf node.
+const LeafSize = 128 * 1024
+
+// Domain-separation prefixes, so a leaf hash can never collide with an
+// internal node hash of the same preimage.
+const (
+	leafPrefix     = 0x00
+	internalPrefix = 0x01
+)
+
+// Digest is a single tree-hash output.
+type Digest [sha256.Size]byte
+
+// node is a completed subtree hash together with its height (0 = leaf).
+type node struct {
+	hash   Digest
+	height int
+}
+
+// Hasher accumulates a Merkle tree over the bytes written to it. The zero
+// value is not usable; use New.
+type Hasher struct {
+	buf   []byte
+	stack []node
+
+	// OnLeaf, if set, is called with the hash of every completed leaf (the
+	// final, possibly short, leaf included) in write order. Callers that
+	// need to persist per-leaf digests for later partial verification -
+	// without holding the whole tree in memory - can use it to stream
+	// leaf hashes straight to disk.
+	OnLeaf func(Digest)
+}
+
+// New returns a Hasher ready to accept writes.
+func New() *Hasher {
+	return &Hasher{buf: make([]byte, 0, LeafSize)}
+}
+
+// Write feeds more plaintext bytes into the tree. It never returns an error.
+func (h *Hasher) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := LeafSize - len(h.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		h.buf = append(h.buf, p[:n]...)
+		p = p[n:]
+		if len(h.buf) == LeafSize {
+			h.pushLeaf(h.buf)
+			h.buf = h.buf[:0]
+		}
+	}
+	return total, nil
+}
+
+// pushLeaf hashes a full (or final, partial) leaf and folds it onto the
+// subtree stack, merging any pending sibling at the same height.
+func (h *Hasher) pushLeaf(leaf []byte) {
+	d := LeafHash(leaf)
+	if h.OnLeaf != nil {
+		h.OnLeaf(d)
+	}
+	h.push(node{hash: d, height: 0})
+}
+
+func (h *Hasher) push(n node) {
+	h.stack = append(h.stack, n)
+	for len(h.stack) >= 2 {
+		top := h.stack[len(h.stack)-1]
+		left := h.stack[len(h.stack)-2]
+		if top.height != left.height {
+			break
+		}
+		h.stack = h.stack[:len(h.stack)-2]
+		h.stack = append(h.stack, node{hash: hashInternal(left.hash, top.hash), height: top.height + 1})
+	}
+}
+
+// Sum finalizes the tree: any buffered partial leaf is hashed, and any odd
+// right sibling left on the stack is folded against a duplicate of itself
+// so the stack collapses to a single root. Sum does not reset the Hasher.
+func (h *Hasher) Sum() Digest {
+	stack := append([]node(nil), h.stack...)
+	if len(h.buf) > 0 {
+		d := LeafHash(h.buf)
+		if h.OnLeaf != nil {
+			h.OnLeaf(d)
+		}
+		stack = foldPush(stack, node{hash: d, height: 0})
+	}
+	if len(stack) == 0 {
+		sum := sha256.New()
+		sum.Write([]byte{leafPrefix})
+		return toDigest(sum.Sum(nil))
+	}
+	for len(stack) > 1 {
+		n := len(stack)
+		top := stack[n-1]
+		left := stack[n-2]
+		if top.height == left.height {
+			stack = stack[:n-2]
+			stack = append(stack, node{hash: hashInternal(left.hash, top.hash), height: top.height + 1})
+			continue
+		}
+		// top is a shorter, unpaired subtree: duplicate it against itself
+		// to climb one level and try to pair again.
+		stack[n-1] = node{hash: hashInternal(top.hash, top.hash), height: top.height + 1}
+	}
+	return stack[0].hash
+}
+
+func foldPush(stack []node, n node) []node {
+	stack = append(stack, n)
+	for len(stack) >= 2 {
+		top := stack[len(stack)-1]
+		left := stack[len(stack)-2]
+		if top.height != left.height {
+			break
+		}
+		stack = stack[:len(stack)-2]
+		stack = append(stack, node{hash: hashInternal(left.hash, top.hash), height: top.height + 1})
+	}
+	return stack
+}
+
+func hashInternal(left, right Digest) Digest {
+	sum := sha256.New()
+	sum.Write([]byte{internalPrefix})
+	sum.Write(left[:])
+	sum.Write(right[:])
+	return toDigest(sum.Sum(nil))
+}
+
+// Root folds a list of already-computed digests - e.g. the per-table roots
+// recorded in a plot's footer - into a single digest, by repeatedly hashing
+// adjacent pairs together (duplicating a trailing odd one out) until one
+// digest remains. It lets a caller bind several independent hashes into one
+// overall root without streaming them through a Hasher.
+func Root(digests []Digest) Digest {
+	if len(digests) == 0 {
+		return New().Sum()
+	}
+
+	level := append([]Digest(nil), digests...)
+	for len(level) > 1 {
+		next := make([]Digest, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, hashInternal(level[i], level[i+1]))
+			} else {
+				next = append(next, hashInternal(level[i], level[i]))
+			}
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Tree is a full Merkle tree built from a fixed list of leaf digests via
+// Root's pairwise-fold-with-odd-duplicate rule, keeping every intermediate
+// level instead of only the final root. It lets a caller hand out a compact
+// O(log N) authentication path for any leaf, so a verifier only needs that
+// leaf's own (recomputed) hash and its path to confirm it belongs under the
+// tree's root - without needing every other leaf's digest.
+type Tree struct {
+	levels [][]Digest
+}
+
+// BuildTree builds a Tree over leaves. The zero-leaf case matches Root: the
+// tree's single level is the empty-input digest.
+func BuildTree(leaves []Digest) Tree {
+	if len(leaves) == 0 {
+		return Tree{levels: [][]Digest{{New().Sum()}}}
+	}
+
+	levels := [][]Digest{append([]Digest(nil), leaves...)}
+	for level := levels[0]; len(level) > 1; {
+		next := make([]Digest, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, hashInternal(level[i], level[i+1]))
+			} else {
+				next = append(next, hashInternal(level[i], level[i]))
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return Tree{levels: levels}
+}
+
+// TreeFromLevels rebuilds a Tree from its levels as returned by Levels - used
+// to reconstruct a Tree read back from storage without re-hashing anything.
+func TreeFromLevels(levels [][]Digest) Tree {
+	return Tree{levels: levels}
+}
+
+// Levels returns t's levels, leaves first and the single root last, for
+// callers that need to persist or transmit the whole tree.
+func (t Tree) Levels() [][]Digest {
+	return t.levels
+}
+
+// Root returns t's root digest.
+func (t Tree) Root() Digest {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// NumLeaves returns the number of leaves t was built from.
+func (t Tree) NumLeaves() int {
+	return len(t.levels[0])
+}
+
+// Path returns the O(log N) sibling digests needed to recompute t's root
+// from leaf, in bottom-up order - the authentication path VerifyPath expects.
+func (t Tree) Path(leaf int) []Digest {
+	path := make([]Digest, 0, len(t.levels)-1)
+	idx := leaf
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := idx ^ 1
+		if sibling >= len(level) {
+			// leaf is the lone, unpaired node at this level - Root/BuildTree
+			// duplicate it against itself, so its "sibling" is itself.
+			sibling = idx
+		}
+		path = append(path, level[sibling])
+		idx /= 2
+	}
+	return path
+}
+
+// VerifyPath reports whether leaf, found at index among a tree's leaves,
+// folds up through path (as returned by Tree.Path) to root.
+func VerifyPath(leaf Digest, index int, path []Digest, root Digest) bool {
+	cur := leaf
+	for _, sibling := range path {
+		if index%2 == 0 {
+			cur = hashInternal(cur, sibling)
+		} else {
+			cur = hashInternal(sibling, cur)
+		}
+		index /= 2
+	}
+	return cur == root
+}
+
+// LeafHash hashes a single leaf's worth of plaintext in isolation. It is
+// used on the verification side to recompute and compare individual leaves
+// without rebuilding the whole tree.
+func LeafHash(leaf []byte) Digest {
+	sum := sha256.New()
+	sum.Write([]byte{leafPrefix})
+	sum.Write(leaf)
+	return toDigest(sum.Sum(nil))
+}
+
+func toDigest(b []byte) Digest {
+	var d Digest
+	copy(d[:], b)
+	return d
+}
@@ -0,0 +1,144 @@
+package mth
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestHasherIncrementalMatchesOneShot checks that feeding bytes into a
+// Hasher across many small Write calls produces the same root as a single
+// Write of the whole buffer, for inputs spanning several leaf boundaries.
+func TestHasherIncrementalMatchesOneShot(t *testing.T) {
+	data := bytes.Repeat([]byte{0xAB}, LeafSize*3+1000)
+
+	oneShot := New()
+	oneShot.Write(data)
+	want := oneShot.Sum()
+
+	for _, chunkSize := range []int{1, 7, 4096} {
+		incremental := New()
+		for off := 0; off < len(data); off += chunkSize {
+			end := off + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			incremental.Write(data[off:end])
+		}
+		if got := incremental.Sum(); got != want {
+			t.Fatalf("chunkSize=%d: incremental Sum() = %x, want %x (one-shot)", chunkSize, got, want)
+		}
+	}
+}
+
+// TestHasherEmpty checks that a Hasher with no writes at all produces a
+// stable, well-defined root rather than panicking on an empty stack.
+func TestHasherEmpty(t *testing.T) {
+	h := New()
+	got := h.Sum()
+	want := LeafHash(nil)
+	if got != want {
+		t.Fatalf("empty Hasher Sum() = %x, want %x (LeafHash(nil))", got, want)
+	}
+}
+
+// TestHasherSumIsIdempotent checks that calling Sum() twice in a row (with
+// no writes in between) returns the same digest both times.
+func TestHasherSumIsIdempotent(t *testing.T) {
+	h := New()
+	h.Write(bytes.Repeat([]byte{0x01}, LeafSize+10))
+	first := h.Sum()
+	second := h.Sum()
+	if first != second {
+		t.Fatalf("Sum() not idempotent: got %x then %x", first, second)
+	}
+}
+
+// TestRootEvenAndOddCounts checks that Root folds both a power-of-two and a
+// non-power-of-two number of digests down to a single, deterministic value,
+// and that it is sensitive to the order of its input.
+func TestRootEvenAndOddCounts(t *testing.T) {
+	digests := make([]Digest, 5)
+	for i := range digests {
+		digests[i] = LeafHash([]byte{byte(i)})
+	}
+
+	for _, n := range []int{1, 2, 3, 4, 5} {
+		got := Root(digests[:n])
+		again := Root(digests[:n])
+		if got != again {
+			t.Fatalf("Root(digests[:%d]) not deterministic: %x vs %x", n, got, again)
+		}
+	}
+
+	reversed := make([]Digest, len(digests))
+	for i, d := range digests {
+		reversed[len(digests)-1-i] = d
+	}
+	if Root(digests) == Root(reversed) {
+		t.Fatal("Root should depend on the order of its input")
+	}
+}
+
+// TestRootEmpty checks Root's documented zero-digest behavior matches a
+// fresh Hasher's empty Sum().
+func TestRootEmpty(t *testing.T) {
+	if Root(nil) != New().Sum() {
+		t.Fatal("Root(nil) should match the empty Hasher's Sum()")
+	}
+}
+
+// TestLeafHashDomainSeparation checks that LeafHash never collides with the
+// internal-node hash of the same bytes, which is what lets a leaf and an
+// internal node with the same preimage be told apart.
+func TestLeafHashDomainSeparation(t *testing.T) {
+	leaf := []byte("some entry bytes")
+	if LeafHash(leaf) == hashInternal(toDigest(leaf), toDigest(leaf)) {
+		t.Fatal("leaf and internal-node hashes collided for the same preimage")
+	}
+}
+
+// TestLeafHashDeterministic checks that hashing the same leaf bytes twice
+// produces the same digest, and that different bytes produce different
+// digests.
+func TestLeafHashDeterministic(t *testing.T) {
+	a := LeafHash([]byte("leaf-a"))
+	if a != LeafHash([]byte("leaf-a")) {
+		t.Fatal("LeafHash is not deterministic")
+	}
+	if a == LeafHash([]byte("leaf-b")) {
+		t.Fatal("different leaves hashed to the same digest")
+	}
+}
+
+// TestTreePathVerifies checks that every leaf's authentication path, as
+// returned by Tree.Path, verifies against the tree's root - for both
+// power-of-two and non-power-of-two leaf counts - and that it is rejected
+// once the leaf itself is tampered with.
+func TestTreePathVerifies(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 13} {
+		leaves := make([]Digest, n)
+		for i := range leaves {
+			leaves[i] = LeafHash([]byte{byte(i)})
+		}
+		tree := BuildTree(leaves)
+		if tree.NumLeaves() != n {
+			t.Fatalf("n=%d: NumLeaves() = %d", n, tree.NumLeaves())
+		}
+		if tree.Root() != Root(leaves) {
+			t.Fatalf("n=%d: BuildTree root does not match Root()", n)
+		}
+
+		for i, leaf := range leaves {
+			path := tree.Path(i)
+			if !VerifyPath(leaf, i, path, tree.Root()) {
+				t.Fatalf("n=%d leaf=%d: valid path rejected", n, i)
+			}
+
+			tampered := leaf
+			tampered[0] ^= 0xFF
+			if VerifyPath(tampered, i, path, tree.Root()) {
+				t.Fatalf("n=%d leaf=%d: tampered leaf accepted", n, i)
+			}
+		}
+	}
+}
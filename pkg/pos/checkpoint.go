@@ -0,0 +1,299 @@
+package pos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// tableRange is the [Offset, Offset+Length) byte range of a table that has
+// been fully written to the plot file.
+type tableRange struct {
+	Offset int64
+	Length int64
+}
+
+// checkpoint is the state needed to resume an interrupted WritePlotFile run:
+// which table is in progress, where its input and output regions start, the
+// entry size currently in use, how many bytes of the in-progress table have
+// been written, how many x values have been computed so far while table 1
+// (F1) is in progress, whether F1 had already finished (see F1Done), and the
+// byte range of every table already finished - needed to rebuild the
+// integrity footer without re-deriving each table's range from whichever one
+// happens to still be in progress.
+type checkpoint struct {
+	K             int
+	ID            []byte
+	Memo          []byte
+	CurrentTable  int
+	PreviousStart int64
+	CurrentStart  int64
+	EntryLen      int
+	Wrote         int64
+	F1Progress    uint64
+	// F1Done marks a checkpoint taken after table 1 was fully computed but
+	// before sort.OnDisk ran on it. sort.OnDisk reorders table 1's bytes in
+	// place, so once this is set the bytes recorded by F1Progress/Wrote can
+	// no longer be trusted as still-unsorted F1 output if the run crashes
+	// mid-sort - runPlot uses it to tell "resume F1 partway through" apart
+	// from "redo F1 from scratch, its output may already be half-sorted".
+	F1Done    bool
+	Completed []tableRange
+}
+
+// journalPath returns the sidecar journal path for a plot file.
+func journalPath(filename string) string {
+	return filename + ".journal"
+}
+
+// writeCheckpoint atomically replaces filename's journal with cp. The
+// record is written to a temporary file and renamed into place, so a crash
+// during the write never leaves a torn journal behind; the record itself is
+// length-prefixed and CRC32-checked so a journal left over from a crash
+// during the rename (or read back from an unsynced filesystem) is detected
+// as corrupt rather than silently trusted.
+func writeCheckpoint(path string, cp checkpoint) error {
+	payload := encodeCheckpoint(cp)
+
+	var record bytes.Buffer
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(payload)))
+	record.Write(lenBuf[:])
+	record.Write(payload)
+
+	var crcBuf [4]byte
+	binary.BigEndian.PutUint32(crcBuf[:], crc32.ChecksumIEEE(payload))
+	record.Write(crcBuf[:])
+
+	tmp := path + ".tmp"
+	f, err := AppFs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write journal: %v", err)
+	}
+	if _, err := f.Write(record.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write journal: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write journal: %v", err)
+	}
+
+	return AppFs.Rename(tmp, path)
+}
+
+// readCheckpoint reads and validates the journal at path.
+func readCheckpoint(path string) (checkpoint, error) {
+	raw, err := afero.ReadFile(AppFs, path)
+	if err != nil {
+		return checkpoint{}, fmt.Errorf("cannot read journal: %v", err)
+	}
+	if len(raw) < 8 {
+		return checkpoint{}, fmt.Errorf("journal %s is truncated", path)
+	}
+
+	payloadLen := binary.BigEndian.Uint32(raw[:4])
+	if uint32(len(raw)) < 4+payloadLen+4 {
+		return checkpoint{}, fmt.Errorf("journal %s is truncated", path)
+	}
+	payload := raw[4 : 4+payloadLen]
+	wantCRC := binary.BigEndian.Uint32(raw[4+payloadLen : 4+payloadLen+4])
+	if crc32.ChecksumIEEE(payload) != wantCRC {
+		return checkpoint{}, fmt.Errorf("journal %s failed its checksum", path)
+	}
+
+	return decodeCheckpoint(payload)
+}
+
+func encodeCheckpoint(cp checkpoint) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteByte(byte(cp.K))
+
+	buf.WriteByte(byte(len(cp.ID)))
+	buf.Write(cp.ID)
+
+	var u16 [2]byte
+	binary.BigEndian.PutUint16(u16[:], uint16(len(cp.Memo)))
+	buf.Write(u16[:])
+	buf.Write(cp.Memo)
+
+	buf.WriteByte(byte(cp.CurrentTable))
+
+	var u64 [8]byte
+	writeU64 := func(v uint64) {
+		binary.BigEndian.PutUint64(u64[:], v)
+		buf.Write(u64[:])
+	}
+	writeU64(uint64(cp.PreviousStart))
+	writeU64(uint64(cp.CurrentStart))
+	writeU64(uint64(cp.EntryLen))
+	writeU64(uint64(cp.Wrote))
+	writeU64(cp.F1Progress)
+
+	var f1Done byte
+	if cp.F1Done {
+		f1Done = 1
+	}
+	buf.WriteByte(f1Done)
+
+	binary.Write(&buf, binary.BigEndian, uint32(len(cp.Completed)))
+	for _, rng := range cp.Completed {
+		writeU64(uint64(rng.Offset))
+		writeU64(uint64(rng.Length))
+	}
+
+	return buf.Bytes()
+}
+
+func decodeCheckpoint(payload []byte) (checkpoint, error) {
+	r := bytes.NewReader(payload)
+	var cp checkpoint
+
+	kByte, err := r.ReadByte()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.K = int(kByte)
+
+	idLen, err := r.ReadByte()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.ID = make([]byte, idLen)
+	if _, err := io.ReadFull(r, cp.ID); err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+
+	var memoLen uint16
+	if err := binary.Read(r, binary.BigEndian, &memoLen); err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.Memo = make([]byte, memoLen)
+	if _, err := io.ReadFull(r, cp.Memo); err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+
+	tableByte, err := r.ReadByte()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.CurrentTable = int(tableByte)
+
+	readU64 := func() (uint64, error) {
+		var v uint64
+		err := binary.Read(r, binary.BigEndian, &v)
+		return v, err
+	}
+
+	previousStart, err := readU64()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.PreviousStart = int64(previousStart)
+
+	currentStart, err := readU64()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.CurrentStart = int64(currentStart)
+
+	entryLen, err := readU64()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.EntryLen = int(entryLen)
+
+	wrote, err := readU64()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.Wrote = int64(wrote)
+
+	f1Progress, err := readU64()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.F1Progress = f1Progress
+
+	f1DoneByte, err := r.ReadByte()
+	if err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.F1Done = f1DoneByte != 0
+
+	var numCompleted uint32
+	if err := binary.Read(r, binary.BigEndian, &numCompleted); err != nil {
+		return cp, fmt.Errorf("cannot decode journal: %v", err)
+	}
+	cp.Completed = make([]tableRange, numCompleted)
+	for i := range cp.Completed {
+		offset, err := readU64()
+		if err != nil {
+			return cp, fmt.Errorf("cannot decode journal: %v", err)
+		}
+		length, err := readU64()
+		if err != nil {
+			return cp, fmt.Errorf("cannot decode journal: %v", err)
+		}
+		cp.Completed[i] = tableRange{Offset: int64(offset), Length: int64(length)}
+	}
+
+	return cp, nil
+}
+
+// ResumePlotFile resumes a WritePlotFile run for filename from the
+// checkpoint recorded in its sidecar journal (<filename>.journal). It
+// validates that the journal's recorded (k, id, memo) matches the plot
+// file's on-disk header, truncates the plot file back to the last
+// checkpointed offset, and continues from there - either partway through
+// F1, or at the start of whichever table was in progress.
+func ResumePlotFile(filename string, availableMemory int) error {
+	return ResumePlotFileWithOptions(filename, availableMemory, DefaultPlotOptions())
+}
+
+// ResumePlotFileWithOptions is ResumePlotFile with explicit control over the
+// worker and chunk-buffer pool sizes used for the remainder of the run.
+func ResumePlotFileWithOptions(filename string, availableMemory int, opts PlotOptions) error {
+	file, headerLen, cp, err := prepareResume(filename)
+	if err != nil {
+		return err
+	}
+	return runPlot(file, filename, headerLen, cp.K, cp.Memo, cp.ID, availableMemory, opts, &cp)
+}
+
+// prepareResume validates filename's journal against the plot file's on-disk
+// header and truncates the plot file back to the byte offset recorded in
+// the last checkpoint, discarding anything written after it by the run that
+// crashed. It returns the open, truncated file, its header length, and the
+// parsed checkpoint, ready to hand to runPlot.
+func prepareResume(filename string) (afero.File, int, checkpoint, error) {
+	cp, err := readCheckpoint(journalPath(filename))
+	if err != nil {
+		return nil, 0, checkpoint{}, fmt.Errorf("cannot resume %s: %v", filename, err)
+	}
+
+	file, err := AppFs.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, checkpoint{}, err
+	}
+
+	headerLen, k, memo, id, err := ReadHeader(file)
+	if err != nil {
+		return nil, 0, checkpoint{}, err
+	}
+	if k != cp.K || !bytes.Equal(memo, cp.Memo) || !bytes.Equal(id, cp.ID) {
+		return nil, 0, checkpoint{}, fmt.Errorf("journal for %s does not match the plot file's header", filename)
+	}
+
+	truncateAt := cp.CurrentStart + cp.Wrote
+	if err := file.Truncate(truncateAt); err != nil {
+		return nil, 0, checkpoint{}, fmt.Errorf("cannot truncate %s back to its last checkpoint: %v", filename, err)
+	}
+
+	return file, headerLen, cp, nil
+}
@@ -0,0 +1,304 @@
+package pos
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// withMemFs swaps AppFs for an in-memory filesystem for the duration of a
+// test, restoring the previous value on cleanup.
+func withMemFs(t *testing.T) afero.Fs {
+	t.Helper()
+	prev := AppFs
+	mem := afero.NewMemMapFs()
+	AppFs = mem
+	t.Cleanup(func() { AppFs = prev })
+	return mem
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	withMemFs(t)
+
+	cp := checkpoint{
+		K:             18,
+		ID:            bytes.Repeat([]byte{0x07}, 32),
+		Memo:          []byte("memo"),
+		CurrentTable:  3,
+		PreviousStart: 10,
+		CurrentStart:  20,
+		EntryLen:      5,
+		Wrote:         100,
+		F1Progress:    4096,
+		F1Done:        true,
+		Completed: []tableRange{
+			{Offset: 10, Length: 6},
+			{Offset: 16, Length: 4},
+		},
+	}
+
+	path := journalPath("plot.dat")
+	if err := writeCheckpoint(path, cp); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	got, err := readCheckpoint(path)
+	if err != nil {
+		t.Fatalf("readCheckpoint: %v", err)
+	}
+	if got.K != cp.K || !bytes.Equal(got.ID, cp.ID) || !bytes.Equal(got.Memo, cp.Memo) ||
+		got.CurrentTable != cp.CurrentTable || got.PreviousStart != cp.PreviousStart ||
+		got.CurrentStart != cp.CurrentStart || got.EntryLen != cp.EntryLen ||
+		got.Wrote != cp.Wrote || got.F1Progress != cp.F1Progress || got.F1Done != cp.F1Done {
+		t.Fatalf("roundtrip mismatch: got %+v, want %+v", got, cp)
+	}
+	if len(got.Completed) != len(cp.Completed) {
+		t.Fatalf("got %d completed table ranges, want %d", len(got.Completed), len(cp.Completed))
+	}
+	for i, rng := range cp.Completed {
+		if got.Completed[i] != rng {
+			t.Fatalf("completed[%d]: got %+v, want %+v", i, got.Completed[i], rng)
+		}
+	}
+}
+
+func TestWriteCheckpointReplacesPreviousAtomically(t *testing.T) {
+	mem := withMemFs(t)
+
+	path := journalPath("plot.dat")
+	first := checkpoint{K: 18, ID: make([]byte, 32), CurrentTable: 1, Wrote: 10, F1Progress: 4096}
+	if err := writeCheckpoint(path, first); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	second := checkpoint{K: 18, ID: make([]byte, 32), CurrentTable: 2,
+		Completed: []tableRange{{Offset: 0, Length: 10}}}
+	if err := writeCheckpoint(path, second); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	got, err := readCheckpoint(path)
+	if err != nil {
+		t.Fatalf("readCheckpoint: %v", err)
+	}
+	if got.CurrentTable != 2 {
+		t.Fatalf("got CurrentTable %d, want 2 (journal was not replaced)", got.CurrentTable)
+	}
+	if exists, _ := afero.Exists(mem, path+".tmp"); exists {
+		t.Fatalf("temp journal file %s.tmp was left behind after rename", path)
+	}
+}
+
+func TestReadCheckpointDetectsCorruption(t *testing.T) {
+	mem := withMemFs(t)
+
+	path := journalPath("plot.dat")
+	cp := checkpoint{K: 18, ID: make([]byte, 32), CurrentTable: 1, Wrote: 10, F1Progress: 4096}
+	if err := writeCheckpoint(path, cp); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	raw, err := afero.ReadFile(mem, path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	raw[len(raw)-1] ^= 0xFF // flip a bit in the trailing CRC
+	if err := afero.WriteFile(mem, path, raw, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, err := readCheckpoint(path); err == nil {
+		t.Fatal("expected readCheckpoint to reject a corrupted journal, got nil error")
+	}
+}
+
+// TestPrepareResumeMidF1 covers a crash partway through F1: the plot file has
+// a few extra bytes written past the last checkpoint (the partial chunk that
+// never got flushed before the crash), which prepareResume must discard by
+// truncating back to the checkpointed offset.
+func TestPrepareResumeMidF1(t *testing.T) {
+	withMemFs(t)
+
+	filename := "plot.dat"
+	file, err := AppFs.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id := bytes.Repeat([]byte{0x01}, 32)
+	headerLen, err := WriteHeader(file, 18, []byte("memo"), id)
+	if err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if _, err := file.WriteAt(bytes.Repeat([]byte{0xAA}, 96), int64(headerLen+32)); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	file.Close()
+
+	cp := checkpoint{
+		K: 18, ID: id, Memo: []byte("memo"), CurrentTable: 1,
+		PreviousStart: int64(headerLen), CurrentStart: int64(headerLen),
+		Wrote: 32, F1Progress: entriesPerChunk,
+	}
+	if err := writeCheckpoint(journalPath(filename), cp); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	resumed, gotHeaderLen, gotCP, err := prepareResume(filename)
+	if err != nil {
+		t.Fatalf("prepareResume: %v", err)
+	}
+	defer resumed.Close()
+
+	if gotHeaderLen != headerLen {
+		t.Fatalf("got headerLen %d, want %d", gotHeaderLen, headerLen)
+	}
+	if gotCP.CurrentTable != 1 || gotCP.F1Progress != entriesPerChunk {
+		t.Fatalf("unexpected checkpoint: %+v", gotCP)
+	}
+
+	info, err := resumed.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if want := int64(headerLen) + 32; info.Size() != want {
+		t.Fatalf("file not truncated back to checkpointed F1 offset: got %d, want %d", info.Size(), want)
+	}
+}
+
+// TestPrepareResumeF1DoneKeepsTableBytes covers a crash partway through
+// sort.OnDisk: the last checkpoint on record is the F1Done marker taken
+// right before the sort started, recording the table's full length rather
+// than some partial F1 chunk offset. prepareResume must not truncate away
+// any of that length - runPlot relies on recomputing table 1 in place over
+// exactly that many bytes when it sees F1Done.
+func TestPrepareResumeF1DoneKeepsTableBytes(t *testing.T) {
+	withMemFs(t)
+
+	filename := "plot.dat"
+	file, err := AppFs.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id := bytes.Repeat([]byte{0x05}, 32)
+	headerLen, err := WriteHeader(file, 18, []byte("memo"), id)
+	if err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if _, err := file.WriteAt(bytes.Repeat([]byte{0xCC}, 128), int64(headerLen)); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	file.Close()
+
+	cp := checkpoint{
+		K: 18, ID: id, Memo: []byte("memo"), CurrentTable: 1,
+		PreviousStart: int64(headerLen), CurrentStart: int64(headerLen),
+		Wrote: 128, F1Progress: entriesPerChunk, F1Done: true,
+	}
+	if err := writeCheckpoint(journalPath(filename), cp); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	resumed, _, gotCP, err := prepareResume(filename)
+	if err != nil {
+		t.Fatalf("prepareResume: %v", err)
+	}
+	defer resumed.Close()
+
+	if !gotCP.F1Done {
+		t.Fatal("expected F1Done to round-trip as true")
+	}
+
+	info, err := resumed.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if want := int64(headerLen) + 128; info.Size() != want {
+		t.Fatalf("table 1 bytes truncated away: got size %d, want %d", info.Size(), want)
+	}
+}
+
+// TestPrepareResumeMidTable covers a crash partway through a later table
+// (table 3): two earlier tables are already recorded as completed, and the
+// in-progress table has trailing garbage past its checkpointed length that
+// prepareResume must truncate away.
+func TestPrepareResumeMidTable(t *testing.T) {
+	withMemFs(t)
+
+	filename := "plot.dat"
+	file, err := AppFs.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id := bytes.Repeat([]byte{0x02}, 32)
+	headerLen, err := WriteHeader(file, 18, nil, id)
+	if err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+
+	table1 := tableRange{Offset: int64(headerLen), Length: 40}
+	table2 := tableRange{Offset: table1.Offset + table1.Length, Length: 30}
+	table3Start := table2.Offset + table2.Length
+	if _, err := file.WriteAt(bytes.Repeat([]byte{0xBB}, int(table2.Offset-table1.Offset)+int(table2.Length)+40), table1.Offset); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	file.Close()
+
+	cp := checkpoint{
+		K: 18, ID: id, CurrentTable: 3,
+		PreviousStart: table2.Offset, CurrentStart: table3Start, EntryLen: 5,
+		Wrote:     20,
+		Completed: []tableRange{table1, table2},
+	}
+	if err := writeCheckpoint(journalPath(filename), cp); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	resumed, _, gotCP, err := prepareResume(filename)
+	if err != nil {
+		t.Fatalf("prepareResume: %v", err)
+	}
+	defer resumed.Close()
+
+	if gotCP.CurrentTable != 3 {
+		t.Fatalf("got CurrentTable %d, want 3", gotCP.CurrentTable)
+	}
+	if len(gotCP.Completed) != 2 || gotCP.Completed[0] != table1 || gotCP.Completed[1] != table2 {
+		t.Fatalf("unexpected completed table history: %+v", gotCP.Completed)
+	}
+
+	info, err := resumed.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if want := table3Start + 20; info.Size() != want {
+		t.Fatalf("file not truncated back to checkpointed table offset: got %d, want %d", info.Size(), want)
+	}
+}
+
+func TestPrepareResumeRejectsMismatchedJournal(t *testing.T) {
+	withMemFs(t)
+
+	filename := "plot.dat"
+	file, err := AppFs.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id := bytes.Repeat([]byte{0x03}, 32)
+	if _, err := WriteHeader(file, 18, []byte("memo"), id); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	file.Close()
+
+	// The journal records a different id than the one in the plot file's
+	// header - as if it were left over from a different, unrelated run.
+	otherID := bytes.Repeat([]byte{0x04}, 32)
+	cp := checkpoint{K: 18, ID: otherID, Memo: []byte("memo"), CurrentTable: 2}
+	if err := writeCheckpoint(journalPath(filename), cp); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	if _, _, _, err := prepareResume(filename); err == nil {
+		t.Fatal("expected prepareResume to reject a journal that does not match the plot file's header")
+	}
+}
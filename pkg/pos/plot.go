@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"os"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/spf13/afero"
@@ -16,6 +19,55 @@ import (
 
 var AppFs = afero.NewOsFs()
 
+// entriesPerChunk controls how many table entries a single worker computes
+// before handing its chunk buffer back to the writer goroutine. It is a
+// tradeoff between scheduling overhead (small chunks) and memory held per
+// in-flight chunk (large chunks) - see PlotOptions.BucketBytes for the
+// memory side of that tradeoff.
+const entriesPerChunk = 4096
+
+// PlotOptions tunes the concurrency and memory footprint of WritePlotFile.
+// The zero value is not useable directly; build one with DefaultPlotOptions.
+type PlotOptions struct {
+	// Workers is the number of goroutines used to compute F1 outputs and to
+	// match/collate buckets for tables 2-7. Defaults to runtime.GOMAXPROCS(0).
+	Workers int
+	// BucketBytes is the approximate size, in bytes, of a single chunk
+	// buffer handed to a worker. Combined with the available memory budget
+	// it bounds how many chunks may be in flight at once.
+	BucketBytes int
+	// CheckpointBytes is how many bytes of F1 output to write between
+	// journal checkpoints (see checkpoint.go). Zero disables F1
+	// checkpointing; a checkpoint is still taken after every table.
+	CheckpointBytes int
+}
+
+// DefaultPlotOptions returns the default PlotOptions: one worker per
+// GOMAXPROCS, 1 MiB chunk buffers and an F1 checkpoint every 64 MiB. It does
+// not depend on the memory budget; the number of chunks in flight is derived
+// from availableMemory by each plotting call (see tokens). Callers
+// that want tighter control over worker count or chunk size can build a
+// PlotOptions directly and pass it to WritePlotFileWithOptions.
+func DefaultPlotOptions() PlotOptions {
+	return PlotOptions{
+		Workers:         runtime.GOMAXPROCS(0),
+		BucketBytes:     1 << 20, // 1 MiB per in-flight chunk
+		CheckpointBytes: 64 << 20,
+	}
+}
+
+// tokens returns how many chunk buffers are allowed in flight at once:
+// availableMemory / BucketBytes, but never fewer than Workers. When
+// availableMemory is smaller than Workers*BucketBytes, the chunks in flight
+// can therefore take more memory than availableMemory.
+func (o PlotOptions) tokens(availableMemory int) int {
+	n := availableMemory / o.BucketBytes
+	if n < o.Workers {
+		n = o.Workers
+	}
+	return n
+}
+
 // This is Phase 1, or forward propagation. During this phase, all of the 7 tables,
 // and f functions, are evaluated. The result is an intermediate plot file, that is
 // several times larger than what the final file will be, but that has all of the
@@ -23,6 +75,15 @@ var AppFs = afero.NewOsFs()
 // AES256, and each encryption provides multiple output values. Then, the rest of the
 // f functions are computed, and a sort on disk happens for each table.
 func WritePlotFile(filename string, k, availableMemory int, memo, id []byte) error {
+	return WritePlotFileWithOptions(filename, k, availableMemory, memo, id, DefaultPlotOptions())
+}
+
+// WritePlotFileWithOptions is WritePlotFile with explicit control over the
+// worker and chunk-buffer pool sizes used for F1 and table computation. If a
+// journal left over from a previous, interrupted run exists for filename,
+// it is ignored - callers that want to pick that run back up should call
+// ResumePlotFile instead.
+func WritePlotFileWithOptions(filename string, k, availableMemory int, memo, id []byte, opts PlotOptions) error {
 	file, err := AppFs.Create(filename)
 	if err != nil {
 		return err
@@ -33,72 +94,292 @@ func WritePlotFile(filename string, k, availableMemory int, memo, id []byte) err
 		return err
 	}
 
-	fmt.Println("Computing table 1...")
-	start := time.Now()
-	wrote, err := WriteFirstTable(file, k, headerLen, id)
-	if err != nil {
-		return err
-	}
+	return runPlot(file, filename, headerLen, k, memo, id, availableMemory, opts, nil)
+}
+
+// runPlot drives phases 1 and 2 of plotting to completion, checkpointing
+// progress to filename's journal as it goes. When resume is non-nil, it
+// picks up from the recorded checkpoint instead of starting at table 1; see
+// ResumePlotFile. The journal is deleted once the plot file and its
+// integrity footer are complete.
+func runPlot(file afero.File, filename string, headerLen, k int, memo, id []byte, availableMemory int, opts PlotOptions, resume *checkpoint) error {
+	path := journalPath(filename)
+	maxNumber := int(math.Pow(2, float64(k)))
 
-	// if we know beforehand there is not enough space
-	// to sort in memory, we can prepare the spare file
-	var spare afero.File
-	if wrote > availableMemory {
-		spare, err = AppFs.Create(filename + "-spare")
+	// completed records the [offset, length) of every table fully written so
+	// far, table 1 included, so the footer can be built (or a later resume
+	// can pick up) without needing to remember each table's digest in
+	// memory across a crash - the journal only needs to persist the ranges,
+	// and hashTable recomputes the actual digests at the end.
+	var completed []tableRange
+	var previousStart, currentStart, entryLen int
+	startTable := 2
+
+	if resume == nil || resume.CurrentTable <= 1 {
+		fmt.Println("Computing table 1...")
+		start := time.Now()
+
+		var startChunk, startWrote int
+		if resume != nil {
+			completed = append(completed, resume.Completed...)
+			if resume.F1Done {
+				// Table 1 had already finished computing, but the only
+				// checkpoint on record is the one taken right before
+				// sort.OnDisk started - if the crash happened mid-sort, its
+				// in-place reordering may have already scrambled some of
+				// table 1's bytes, so nothing before any offset can be
+				// trusted as still-unsorted F1 output. Recompute it from
+				// scratch rather than resuming partway through.
+				fmt.Println("Table 1 finished but may have crashed mid-sort; recomputing it from scratch...")
+			} else {
+				startChunk = int(resume.F1Progress / entriesPerChunk)
+				startWrote = int(resume.Wrote)
+			}
+		}
+
+		var lastCheckpoint int
+		wrote, err := WriteFirstTable(file, k, headerLen, id, availableMemory, opts, startChunk, startWrote,
+			func(entriesDone uint64, bytesWrote int) error {
+				if opts.CheckpointBytes <= 0 || bytesWrote-lastCheckpoint < opts.CheckpointBytes {
+					return nil
+				}
+				lastCheckpoint = bytesWrote
+				return writeCheckpoint(path, checkpoint{
+					K: k, ID: id, Memo: memo, CurrentTable: 1,
+					PreviousStart: int64(headerLen), CurrentStart: int64(headerLen),
+					Wrote: int64(bytesWrote), F1Progress: entriesDone,
+					Completed: completed,
+				})
+			})
 		if err != nil {
 			return err
 		}
-	}
 
-	fmt.Println("Sorting table 1...")
-	maxNumber := int(math.Pow(2, float64(k)))
-	entryLen := wrote / maxNumber
-	if err := sort.OnDisk(file, spare, headerLen, wrote+headerLen, availableMemory, entryLen, maxNumber, k); err != nil {
-		return err
+		// Mark F1 as complete before sort.OnDisk starts reordering its bytes
+		// in place - if the process crashes mid-sort, this is the last
+		// checkpoint on record, and its F1Done flag tells a later resume
+		// that table 1 must be recomputed from scratch rather than trusted
+		// up to some F1 chunk offset (see the F1Done branch above).
+		if err := writeCheckpoint(path, checkpoint{
+			K: k, ID: id, Memo: memo, CurrentTable: 1,
+			PreviousStart: int64(headerLen), CurrentStart: int64(headerLen),
+			Wrote: int64(wrote), F1Progress: uint64(maxNumber), F1Done: true,
+			Completed: completed,
+		}); err != nil {
+			return err
+		}
+
+		// if we know beforehand there is not enough space
+		// to sort in memory, we can prepare the spare file
+		var spare afero.File
+		if wrote > availableMemory {
+			spare, err = AppFs.Create(filename + "-spare")
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Println("Sorting table 1...")
+		entryLen = wrote / maxNumber
+		if err := sort.OnDisk(file, spare, headerLen, wrote+headerLen, availableMemory, entryLen, maxNumber, k); err != nil {
+			return err
+		}
+		fmt.Printf("F1 calculations finished in %v (wrote %s)\n", time.Since(start), utils.PrettySize(wrote))
+
+		previousStart = headerLen
+		currentStart = headerLen + wrote
+		completed = append(completed, tableRange{Offset: int64(headerLen), Length: int64(wrote)})
+
+		if err := writeCheckpoint(path, checkpoint{
+			K: k, ID: id, Memo: memo, CurrentTable: 2,
+			PreviousStart: int64(previousStart), CurrentStart: int64(currentStart), EntryLen: entryLen,
+			Completed: completed,
+		}); err != nil {
+			return err
+		}
+	} else {
+		previousStart = int(resume.PreviousStart)
+		currentStart = int(resume.CurrentStart)
+		entryLen = resume.EntryLen
+		completed = append(completed, resume.Completed...)
+		startTable = resume.CurrentTable
 	}
-	fmt.Printf("F1 calculations finished in %v (wrote %s)\n", time.Since(start), utils.PrettySize(wrote))
 
-	fmt.Println("Computing table 2...")
-	start = time.Now()
 	fx, err := NewFx(uint64(k), id)
 	if err != nil {
 		return err
 	}
 
-	previousStart := headerLen
-	currentStart := headerLen + wrote
-	for t := 2; t <= 7; t++ {
-		wrote, err := WriteTable(file, k, t, previousStart, currentStart, entryLen, fx)
+	for t := startTable; t <= 7; t++ {
+		fmt.Printf("Computing table %d...\n", t)
+		wrote, err := WriteTable(file, k, t, previousStart, currentStart, entryLen, fx, availableMemory, opts)
 		if err != nil {
 			return err
 		}
+
+		completed = append(completed, tableRange{Offset: int64(currentStart), Length: int64(wrote)})
 		previousStart += wrote
 		currentStart += wrote
 		entryLen = wrote / maxNumber
-		break // TODO: REMOVE
+
+		if err := writeCheckpoint(path, checkpoint{
+			K: k, ID: id, Memo: memo, CurrentTable: t + 1,
+			PreviousStart: int64(previousStart), CurrentStart: int64(currentStart), EntryLen: entryLen,
+			Completed: completed,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// All 7 tables are on disk; hash each recorded range now that none of
+	// them will move again (sort.OnDisk only ever touches table 1, and that
+	// happened before its range was recorded above) and write the footer.
+	tables := make([]tableDigest, 0, len(completed))
+	for _, rng := range completed {
+		digest, err := hashTable(file, rng.Offset, rng.Length)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, digest)
 	}
 
+	if err := writeFooter(file, k, tables); err != nil {
+		return err
+	}
+	// The plot and its footer are complete; the journal is no longer needed.
+	if err := AppFs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
-func WriteFirstTable(file afero.File, k, start int, id []byte) (int, error) {
+// f1Chunk is a contiguous, already-serialized range of F1 entries produced by
+// a single worker. buf is leased from a sync.Pool and returned once the
+// writer goroutine has flushed it.
+type f1Chunk struct {
+	seq int
+	buf []byte
+}
+
+// WriteFirstTable computes F1 for every x in [0, 2^k) and writes the result
+// to file starting at start. Computation is fanned out across opts.Workers
+// goroutines, each one serializing a chunk of entriesPerChunk values into a
+// pooled buffer; a single writer goroutine flushes chunks back to disk in
+// sequence order so the on-disk layout is unaffected by worker scheduling.
+// A token channel sized from availableMemory bounds how many chunk buffers
+// can be allocated and in flight at once.
+//
+// startChunk and startWrote let a caller resume a previously interrupted
+// run: chunks before startChunk are assumed to already be correct on disk
+// (from a prior checkpoint) and are not recomputed, and wrote begins at
+// startWrote instead of 0. Pass 0, 0 to compute the table from scratch.
+// onProgress, if non-nil, is called after every chunk is flushed to disk
+// with the number of entries and bytes written so far; it is used to drive
+// journal checkpoints and may be called from the same goroutine that calls
+// WriteFirstTable.
+func WriteFirstTable(file afero.File, k, start int, id []byte, availableMemory int, opts PlotOptions, startChunk, startWrote int, onProgress func(entriesDone uint64, wrote int) error) (int, error) {
 	f1, err := NewF1(k, id)
 	if err != nil {
 		return 0, err
 	}
 
-	var wrote int
 	maxNumber := uint64(math.Pow(2, float64(k)))
+	numChunks := int((maxNumber + entriesPerChunk - 1) / entriesPerChunk)
 
-	// TODO: Batch writes
-	for x := uint64(0); x < maxNumber; x++ {
-		f1x := f1.Calculate(x)
-		n, err := serialize.Write(file, int64(start+wrote), x, f1x, k)
-		if err != nil {
-			return wrote + n, err
+	pool := sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 0, opts.BucketBytes)
+		},
+	}
+	tokens := make(chan struct{}, opts.tokens(availableMemory))
+
+	work := make(chan int, numChunks-startChunk)
+	for seq := startChunk; seq < numChunks; seq++ {
+		work <- seq
+	}
+	close(work)
+
+	results := make(chan f1Chunk, opts.Workers)
+	var wg sync.WaitGroup
+	wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for seq := range work {
+				tokens <- struct{}{} // acquire: bound the number of chunk buffers in flight
+				buf := pool.Get().([]byte)[:0]
+
+				lo := uint64(seq) * entriesPerChunk
+				hi := lo + entriesPerChunk
+				if hi > maxNumber {
+					hi = maxNumber
+				}
+				for x := lo; x < hi; x++ {
+					f1x := f1.Calculate(x)
+					buf = serialize.Append(buf, x, f1x, k)
+				}
+
+				results <- f1Chunk{seq: seq, buf: buf}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// drain discards any results still in flight, releasing their tokens as
+	// it goes so workers blocked on a token acquire (or on sending to the
+	// now-unread results channel) can make progress and exit instead of
+	// leaking - mirrors the close(jobs)/wg.Wait()/close(results) sequence
+	// WriteTable uses on its error paths, adapted to this function's single
+	// writer loop (there is no separate writer goroutine to wait on here).
+	drain := func(pending map[int]f1Chunk) {
+		// Chunks parked in pending still hold their tokens too.
+		for range pending {
+			<-tokens
+		}
+		for range results {
+			<-tokens
 		}
-		wrote += n
 	}
+
+	// The writer is the only goroutine touching file, so out-of-order chunk
+	// completions are buffered here until the next sequential chunk arrives.
+	pending := make(map[int]f1Chunk)
+	next := startChunk
+	wrote := startWrote
+	for c := range results {
+		pending[c.seq] = c
+		for {
+			rc, ok := pending[next]
+			if !ok {
+				break
+			}
+			if _, err := file.WriteAt(rc.buf, int64(start+wrote)); err != nil {
+				drain(pending)
+				return wrote, err
+			}
+			wrote += len(rc.buf)
+			delete(pending, next)
+			next++
+
+			pool.Put(rc.buf[:0])
+			<-tokens // release: the buffer has been written back and returned to the pool
+
+			if onProgress != nil {
+				entriesDone := uint64(next) * entriesPerChunk
+				if entriesDone > maxNumber {
+					entriesDone = maxNumber
+				}
+				if err := onProgress(entriesDone, wrote); err != nil {
+					drain(pending)
+					return wrote, err
+				}
+			}
+		}
+	}
+
 	if _, err := file.Write([]byte(serialize.EOT)); err != nil {
 		return wrote, err
 	}
@@ -106,11 +387,30 @@ func WriteFirstTable(file afero.File, k, start int, id []byte) (int, error) {
 	return wrote, nil
 }
 
+// matchJob is a pair of buckets found while scanning the previous table,
+// ready to be matched, collated and turned into entries for the next table.
+type matchJob struct {
+	seq         int
+	t           int
+	leftBucket  []*serialize.Entry
+	rightBucket []*serialize.Entry
+}
+
+// matchResult is the serialized output of processing a single matchJob.
+type matchResult struct {
+	seq int
+	buf []byte
+}
+
 // WriteTable reads the t-1'th table from the file and writes the t'th table.
-func WriteTable(file afero.File, k, t, previousStart, currentStart, entryLen int, fx *Fx) (int, error) {
+// Reading stays single-threaded since bucket boundaries depend on the order
+// entries are read in, but the match/collate/Fx work for each left-right
+// bucket pair found along the way is fanned out across opts.Workers
+// goroutines; a single writer goroutine flushes the resulting entries back
+// to disk in the order the bucket pairs were discovered.
+func WriteTable(file afero.File, k, t, previousStart, currentStart, entryLen int, fx *Fx, availableMemory int, opts PlotOptions) (int, error) {
 	var (
-		read    int
-		written int
+		read int
 
 		bucketID     uint64
 		leftBucketID uint64
@@ -118,8 +418,92 @@ func WriteTable(file afero.File, k, t, previousStart, currentStart, entryLen int
 		rightBucket  []*serialize.Entry
 	)
 
-	var index int
+	bucketPool := sync.Pool{
+		New: func() interface{} {
+			return make([]*serialize.Entry, 0, opts.BucketBytes/entryLen+1)
+		},
+	}
+	bufPool := sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 0, opts.BucketBytes)
+		},
+	}
+	tokens := make(chan struct{}, opts.tokens(availableMemory))
+	leftBucket = bucketPool.Get().([]*serialize.Entry)[:0]
+	rightBucket = bucketPool.Get().([]*serialize.Entry)[:0]
+
+	jobs := make(chan matchJob, opts.Workers)
+	results := make(chan matchResult, opts.Workers)
+	var wg sync.WaitGroup
+	// jobErr records the first error a worker hits while computing Fx or
+	// collating a match, so it reaches the caller of WriteTable instead of
+	// being silently dropped - a matched pair that fails to calculate or
+	// collate means the table being written is incomplete or wrong.
+	var jobErrOnce sync.Once
+	var jobErr error
+	wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				tokens <- struct{}{} // acquire: bound the number of output buffers in flight
+				buf := bufPool.Get().([]byte)[:0]
+
+				for _, m := range FindMatches(job.leftBucket, job.rightBucket) {
+					f, err := fx.Calculate(job.t, m.Left, m.LeftMetadata, m.RightMetadata)
+					if err != nil {
+						jobErrOnce.Do(func() { jobErr = fmt.Errorf("cannot calculate Fx: %v", err) })
+						break
+					}
+					// This is the collated output stored next to the entry -
+					// useful for generating outputs for the next table.
+					collated, err := Collate(job.t, uint64(k), m.LeftMetadata, m.RightMetadata)
+					if err != nil {
+						jobErrOnce.Do(func() { jobErr = fmt.Errorf("cannot collate entry: %v", err) })
+						break
+					}
+					buf = serialize.Append(buf, f, nil, nil, nil, collated, k)
+				}
+
+				results <- matchResult{seq: job.seq, buf: buf}
+
+				bucketPool.Put(job.leftBucket[:0])
+				bucketPool.Put(job.rightBucket[:0])
+			}
+		}()
+	}
+
+	var written int
+	var writeErr error
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		pending := make(map[int]matchResult)
+		next := 0
+		for r := range results {
+			pending[r.seq] = r
+			for {
+				rc, ok := pending[next]
+				if !ok {
+					break
+				}
+				if writeErr == nil {
+					if _, err := file.WriteAt(rc.buf, int64(currentStart+written)); err != nil {
+						writeErr = err
+					} else {
+						written += len(rc.buf)
+					}
+				}
+				delete(pending, next)
+				next++
+
+				bufPool.Put(rc.buf[:0])
+				<-tokens // release: the buffer has been written back and returned to the pool
+			}
+		}
+	}()
 
+	var index, seq int
 	for {
 		// Read an entry
 		leftEntry, bytesRead, err := serialize.Read(file, int64(previousStart+read), entryLen, k)
@@ -127,6 +511,10 @@ func WriteTable(file afero.File, k, t, previousStart, currentStart, entryLen int
 			break
 		}
 		if err != nil {
+			close(jobs)
+			wg.Wait()
+			close(results)
+			<-writerDone
 			return written, fmt.Errorf("cannot read left entry: %v", err)
 		}
 		read += bytesRead
@@ -143,39 +531,43 @@ func WriteTable(file afero.File, k, t, previousStart, currentStart, entryLen int
 			rightBucket = append(rightBucket, leftEntry)
 
 		default:
+			// If the right bucket is about to become the new left bucket,
+			// copy its entries into a fresh pooled slice now, before it is
+			// handed off to a worker (or returned to the pool) below -
+			// aliasing job.rightBucket directly and then mutating it via
+			// append on a later iteration would race with the worker still
+			// reading it in FindMatches.
+			var carryForward []*serialize.Entry
+			if leftBucketID == bucketID+2 {
+				carryForward = bucketPool.Get().([]*serialize.Entry)[:0]
+				carryForward = append(carryForward, rightBucket...)
+			}
+
 			if len(leftBucket) > 0 && len(rightBucket) > 0 {
-				// We have finished adding to both buckets, now we need to compare them.
-				// For any matches, we are going to calculate outputs for the next table.
-				for _, m := range FindMatches(leftBucket, rightBucket) {
-					f, err := fx.Calculate(t, m.Left, m.LeftMetadata, m.RightMetadata)
-					if err != nil {
-						return written, err
-					}
-					// This is the collated output stored next to the entry - useful
-					// for generating outputs for the next table.
-					collated, err := Collate(t, uint64(k), m.LeftMetadata, m.RightMetadata)
-					if err != nil {
-						return written, err
-					}
-					// Now write the new output in the next table.
-					w, err := serialize.Write(file, int64(currentStart+written), f, nil, nil, nil, collated, k)
-					if err != nil {
-						return written + w, err
-					}
-					written += w
-				}
+				// We have finished adding to both buckets; hand them off to a
+				// worker to compare and collate into outputs for the next table.
+				// The worker returns both slices to bucketPool once it is done
+				// reading them.
+				jobs <- matchJob{seq: seq, t: t, leftBucket: leftBucket, rightBucket: rightBucket}
+				seq++
+			} else {
+				bucketPool.Put(leftBucket[:0])
+				bucketPool.Put(rightBucket[:0])
 			}
 			if leftBucketID == bucketID+2 {
-				// Keep the right bucket as the new left bucket
+				// Keep the right bucket's entries as the new left bucket.
 				bucketID++
-				leftBucket = rightBucket
-				rightBucket = nil
+				leftBucket = carryForward
+				rightBucket = bucketPool.Get().([]*serialize.Entry)[:0]
 			} else {
 				// This bucket id is greater than bucketID+2 so we need to
 				// start over building both buckets.
+				if carryForward != nil {
+					bucketPool.Put(carryForward[:0])
+				}
 				bucketID = leftBucketID
-				leftBucket = nil
-				rightBucket = nil
+				leftBucket = bucketPool.Get().([]*serialize.Entry)[:0]
+				rightBucket = bucketPool.Get().([]*serialize.Entry)[:0]
 			}
 		}
 
@@ -183,7 +575,15 @@ func WriteTable(file afero.File, k, t, previousStart, currentStart, entryLen int
 		index++
 	}
 
-	return written, nil
+	close(jobs)
+	wg.Wait()
+	close(results)
+	<-writerDone
+
+	if writeErr != nil {
+		return written, writeErr
+	}
+	return written, jobErr
 }
 
 // WriteHeader writes the plot file header to a file
@@ -221,3 +621,53 @@ func WriteHeader(file afero.File, k int, memo, id []byte) (int, error) {
 	nmore, err = file.Write(memo)
 	return n + nmore, err
 }
+
+// plotMagic is the fixed preamble WriteHeader writes at the start of every
+// plot file.
+const plotMagic = "Proof of Space Plot"
+
+// plotIDLen is the fixed size, in bytes, of a plot's unique id.
+const plotIDLen = 32
+
+// ReadHeader reads back the header WriteHeader wrote to file, returning its
+// length in bytes alongside k, the memo and the plot id. It is used by
+// ResumePlotFile to confirm a journal matches the plot file it names before
+// trusting it.
+func ReadHeader(file afero.File) (headerLen, k int, memo, id []byte, err error) {
+	magic := make([]byte, len(plotMagic))
+	if _, err = io.ReadFull(file, magic); err != nil {
+		return 0, 0, nil, nil, fmt.Errorf("cannot read plot magic: %v", err)
+	}
+	if string(magic) != plotMagic {
+		return 0, 0, nil, nil, fmt.Errorf("not a plot file")
+	}
+	n := len(magic)
+
+	id = make([]byte, plotIDLen)
+	if _, err = io.ReadFull(file, id); err != nil {
+		return 0, 0, nil, nil, fmt.Errorf("cannot read plot id: %v", err)
+	}
+	n += len(id)
+
+	kByte := make([]byte, 1)
+	if _, err = io.ReadFull(file, kByte); err != nil {
+		return 0, 0, nil, nil, fmt.Errorf("cannot read k: %v", err)
+	}
+	n++
+	k = int(kByte[0])
+
+	sizeBuf := make([]byte, 2)
+	if _, err = io.ReadFull(file, sizeBuf); err != nil {
+		return 0, 0, nil, nil, fmt.Errorf("cannot read memo length: %v", err)
+	}
+	n += 2
+	memo = make([]byte, int(sizeBuf[0]))
+	if len(memo) > 0 {
+		if _, err = io.ReadFull(file, memo); err != nil {
+			return 0, 0, nil, nil, fmt.Errorf("cannot read memo: %v", err)
+		}
+	}
+	n += len(memo)
+
+	return n, k, memo, id, nil
+}
@@ -0,0 +1,360 @@
+package pos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/gochia/pkg/mth"
+)
+
+// footerMagic marks the start of the integrity footer WritePlotFile appends
+// to every plot file, so VerifyPlot can tell a plain old plot file (written
+// before this feature existed) apart from a corrupt one.
+var footerMagic = []byte("CHIAPOSMTH1")
+
+// footerLenSize is the width of the trailing length field that lets readers
+// find the start of the footer by seeking back from the end of the file.
+const footerLenSize = 8
+
+// tableDigest is the Merkle tree summary recorded for a single table: its
+// location in the plot file, its root hash, and the full tree built over
+// its leaves, so VerifyRange can check a slice of the table using just the
+// O(log N) authentication path for the leaves it overlaps, rather than
+// every leaf in the table.
+type tableDigest struct {
+	offset int64
+	length int64
+	root   mth.Digest
+	tree   mth.Tree
+}
+
+// footer is the parsed form of the trailer written by writeFooter.
+type footer struct {
+	k           int
+	leafSize    int
+	tables      []tableDigest
+	overallRoot mth.Digest
+}
+
+// hashTable streams the length bytes of a table starting at offset in
+// mth.LeafSize chunks, hashing each leaf in isolation, and folds the
+// resulting leaf digests into a full mth.Tree - giving every leaf a compact
+// O(log N) authentication path for later partial verification instead of
+// requiring every leaf's digest to be read back to check any one of them.
+func hashTable(file afero.File, offset, length int64) (tableDigest, error) {
+	var leaves []mth.Digest
+
+	buf := make([]byte, mth.LeafSize)
+	var read int64
+	for read < length {
+		n := int64(mth.LeafSize)
+		if remaining := length - read; n > remaining {
+			n = remaining
+		}
+		if _, err := file.ReadAt(buf[:n], offset+read); err != nil {
+			return tableDigest{}, fmt.Errorf("cannot read table bytes at offset %d: %v", offset+read, err)
+		}
+		leaves = append(leaves, mth.LeafHash(buf[:n]))
+		read += n
+	}
+
+	tree := mth.BuildTree(leaves)
+	return tableDigest{offset: offset, length: length, root: tree.Root(), tree: tree}, nil
+}
+
+// countingWriter wraps an io.Writer, tallying the bytes written through it
+// so writeFooter can compute the trailing length field without buffering
+// the footer in memory to measure it, and latching the first write error so
+// callers can keep writing field-by-field and check it once at the end.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// writeFooter appends the integrity footer to file: the plot's k, the leaf
+// size used for hashing, each table's offset, length, Merkle root and full
+// authentication tree in table order, and finally the overall root - the
+// per-table roots folded together via mth.Root - that binds every table's
+// integrity into a single hash. Every field is written straight to file as
+// it is produced rather than assembled in memory first, so footer size
+// never dictates how much memory writing it takes. A trailing length field
+// lets readFooter find the start of the footer from the end of the file.
+func writeFooter(file afero.File, k int, tables []tableDigest) error {
+	// Tables are written with WriteAt, which never moves the file cursor, so
+	// seek to the end before appending.
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("cannot write footer: %v", err)
+	}
+
+	roots := make([]mth.Digest, len(tables))
+	for i, t := range tables {
+		roots[i] = t.root
+	}
+	overallRoot := mth.Root(roots)
+
+	cw := &countingWriter{w: file}
+	cw.Write(footerMagic)
+	cw.Write([]byte{byte(k)})
+	binary.Write(cw, binary.BigEndian, uint32(mth.LeafSize))
+	binary.Write(cw, binary.BigEndian, uint32(len(tables)))
+
+	for _, t := range tables {
+		binary.Write(cw, binary.BigEndian, uint64(t.offset))
+		binary.Write(cw, binary.BigEndian, uint64(t.length))
+		cw.Write(t.root[:])
+
+		levels := t.tree.Levels()
+		binary.Write(cw, binary.BigEndian, uint32(len(levels)))
+		for _, level := range levels {
+			binary.Write(cw, binary.BigEndian, uint32(len(level)))
+			for _, d := range level {
+				cw.Write(d[:])
+			}
+		}
+	}
+	cw.Write(overallRoot[:])
+	if cw.err != nil {
+		return fmt.Errorf("cannot write footer: %v", cw.err)
+	}
+
+	var lenBuf [footerLenSize]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(cw.n))
+	_, err := file.Write(lenBuf[:])
+	return err
+}
+
+// readFooter locates and parses the integrity footer at the end of file.
+func readFooter(file afero.File) (*footer, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	var lenBuf [footerLenSize]byte
+	if _, err := file.ReadAt(lenBuf[:], size-footerLenSize); err != nil {
+		return nil, fmt.Errorf("cannot read footer length: %v", err)
+	}
+	footerLen := int64(binary.BigEndian.Uint64(lenBuf[:]))
+	if footerLen < int64(len(footerMagic)) || footerLen > size-footerLenSize {
+		return nil, fmt.Errorf("%s is missing its integrity footer", file.Name())
+	}
+
+	raw := make([]byte, footerLen)
+	if _, err := file.ReadAt(raw, size-footerLenSize-footerLen); err != nil {
+		return nil, fmt.Errorf("cannot read footer: %v", err)
+	}
+
+	r := bytes.NewReader(raw)
+	magic := make([]byte, len(footerMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, footerMagic) {
+		return nil, fmt.Errorf("%s is missing its integrity footer", file.Name())
+	}
+
+	kByte, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read footer: %v", err)
+	}
+
+	var leafSize, numTables uint32
+	if err := binary.Read(r, binary.BigEndian, &leafSize); err != nil {
+		return nil, fmt.Errorf("cannot read footer: %v", err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &numTables); err != nil {
+		return nil, fmt.Errorf("cannot read footer: %v", err)
+	}
+
+	f := &footer{k: int(kByte), leafSize: int(leafSize)}
+	for i := uint32(0); i < numTables; i++ {
+		var off, length uint64
+		if err := binary.Read(r, binary.BigEndian, &off); err != nil {
+			return nil, fmt.Errorf("cannot read footer: %v", err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("cannot read footer: %v", err)
+		}
+
+		var root mth.Digest
+		if _, err := io.ReadFull(r, root[:]); err != nil {
+			return nil, fmt.Errorf("cannot read footer: %v", err)
+		}
+
+		var numLevels uint32
+		if err := binary.Read(r, binary.BigEndian, &numLevels); err != nil {
+			return nil, fmt.Errorf("cannot read footer: %v", err)
+		}
+		levels := make([][]mth.Digest, numLevels)
+		for lvl := range levels {
+			var levelLen uint32
+			if err := binary.Read(r, binary.BigEndian, &levelLen); err != nil {
+				return nil, fmt.Errorf("cannot read footer: %v", err)
+			}
+			level := make([]mth.Digest, levelLen)
+			for j := range level {
+				if _, err := io.ReadFull(r, level[j][:]); err != nil {
+					return nil, fmt.Errorf("cannot read footer: %v", err)
+				}
+			}
+			levels[lvl] = level
+		}
+
+		f.tables = append(f.tables, tableDigest{offset: int64(off), length: int64(length), root: root, tree: mth.TreeFromLevels(levels)})
+	}
+
+	if _, err := io.ReadFull(r, f.overallRoot[:]); err != nil {
+		return nil, fmt.Errorf("cannot read footer: %v", err)
+	}
+
+	return f, nil
+}
+
+// VerifyPlot re-reads filename and recomputes its Merkle tree footer,
+// reporting the offset of the first leaf whose contents no longer match the
+// digest recorded at plot time, a root mismatch for a table whose leaves all
+// match but whose recorded root does not, or a mismatch in the overall root
+// if it no longer matches the recorded per-table roots. This
+// lets callers detect bit-rot or a truncated plot without having to re-plot
+// to find out.
+func VerifyPlot(filename string) error {
+	file, err := AppFs.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f, err := readFooter(file)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range f.tables {
+		if err := verifyTable(file, t, f.leafSize); err != nil {
+			return err
+		}
+	}
+
+	roots := make([]mth.Digest, len(f.tables))
+	for i, t := range f.tables {
+		roots[i] = t.root
+	}
+	if mth.Root(roots) != f.overallRoot {
+		return fmt.Errorf("plot data corrupted: overall root hash mismatch")
+	}
+	return nil
+}
+
+func verifyTable(file afero.File, t tableDigest, leafSize int) error {
+	buf := make([]byte, leafSize)
+	storedLeaves := t.tree.Levels()[0]
+
+	var read int64
+	var leafIdx int
+	var corruptAt int64 = -1
+	var leaves []mth.Digest
+	for read < t.length {
+		n := int64(leafSize)
+		if remaining := t.length - read; n > remaining {
+			n = remaining
+		}
+		if _, err := file.ReadAt(buf[:n], t.offset+read); err != nil {
+			return fmt.Errorf("cannot read table bytes at offset %d: %v", t.offset+read, err)
+		}
+
+		d := mth.LeafHash(buf[:n])
+		if corruptAt < 0 && leafIdx < len(storedLeaves) && d != storedLeaves[leafIdx] {
+			corruptAt = t.offset + read
+		}
+		leaves = append(leaves, d)
+		read += n
+		leafIdx++
+	}
+
+	if corruptAt >= 0 {
+		return fmt.Errorf("plot data corrupted: first differing leaf at offset %d", corruptAt)
+	}
+	if mth.BuildTree(leaves).Root() != t.root {
+		return fmt.Errorf("plot data corrupted: root hash mismatch for table at offset %d", t.offset)
+	}
+	return nil
+}
+
+// VerifyRange checks that the bytes of filename in [offset, offset+length)
+// still match the digests recorded in the footer, reading and hashing only
+// the leaves that overlap that range: each overlapping leaf is recomputed
+// from disk and checked against its table's root using only its O(log N)
+// authentication path, rather than requiring every leaf in the table to
+// have been loaded. It returns an error if the range overlaps no table
+// recorded in the footer, or one identifying the leaf and its offset if a
+// leaf overlapping the range no longer matches. Parts of the range outside
+// every recorded table, such as the header, are not checked.
+func VerifyRange(filename string, offset, length int64) error {
+	file, err := AppFs.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f, err := readFooter(file)
+	if err != nil {
+		return err
+	}
+
+	var checked bool
+	for _, t := range f.tables {
+		if offset+length <= t.offset || offset >= t.offset+t.length {
+			continue
+		}
+
+		lo := offset
+		if lo < t.offset {
+			lo = t.offset
+		}
+		hi := offset + length
+		if hi > t.offset+t.length {
+			hi = t.offset + t.length
+		}
+
+		leafSize := int64(f.leafSize)
+		firstLeaf := int((lo - t.offset) / leafSize)
+		lastLeaf := int((hi - t.offset - 1) / leafSize)
+
+		numLeaves := t.tree.NumLeaves()
+		buf := make([]byte, f.leafSize)
+		for i := firstLeaf; i <= lastLeaf && i < numLeaves; i++ {
+			leafOffset := t.offset + int64(i)*leafSize
+			n := leafSize
+			if remaining := t.length - int64(i)*leafSize; n > remaining {
+				n = remaining
+			}
+			if _, err := file.ReadAt(buf[:n], leafOffset); err != nil {
+				return fmt.Errorf("cannot read leaf %d at offset %d: %v", i, leafOffset, err)
+			}
+			if !mth.VerifyPath(mth.LeafHash(buf[:n]), i, t.tree.Path(i), t.root) {
+				return fmt.Errorf("plot data corrupted: leaf %d (offset %d) does not match its recorded digest", i, leafOffset)
+			}
+		}
+		checked = true
+	}
+
+	if checked {
+		return nil
+	}
+	return fmt.Errorf("range [%d, %d) is outside any table in %s", offset, offset+length, filename)
+}